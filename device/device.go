@@ -0,0 +1,218 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// MaxPeers is the upper bound on how many peers a single Device will track.
+const MaxPeers = 1 << 16
+
+// AtomicBool is a small, allocation-free atomic boolean, used throughout
+// the device package for flags read and written from multiple goroutines
+// without a full mutex (isRunning, isUp, isClosed, ...).
+type AtomicBool struct {
+	bits int32
+}
+
+func (a *AtomicBool) Get() bool {
+	return atomic.LoadInt32(&a.bits) == 1
+}
+
+func (a *AtomicBool) Set(val bool) {
+	if val {
+		atomic.StoreInt32(&a.bits, 1)
+	} else {
+		atomic.StoreInt32(&a.bits, 0)
+	}
+}
+
+// Swap sets the flag to val and reports its previous value.
+func (a *AtomicBool) Swap(val bool) bool {
+	var next int32
+	if val {
+		next = 1
+	}
+	return atomic.SwapInt32(&a.bits, next) == 1
+}
+
+// Logger is the minimal logging sink the device package writes
+// diagnostics to. A nil *Logger, or one constructed with a nil sink, is
+// valid and simply discards output.
+type Logger struct {
+	verbosef func(format string, args ...any)
+}
+
+// NewLogger wraps verbosef (e.g. log.Printf) as a *Logger.
+func NewLogger(verbosef func(format string, args ...any)) *Logger {
+	return &Logger{verbosef: verbosef}
+}
+
+func (l *Logger) Verbosef(format string, args ...any) {
+	if l == nil || l.verbosef == nil {
+		return
+	}
+	l.verbosef(format, args...)
+}
+
+// NoisePublicKey and NoisePrivateKey are raw Curve25519 points, as used by
+// WireGuard's Noise handshake.
+type (
+	NoisePublicKey  [32]byte
+	NoisePrivateKey [32]byte
+)
+
+// sharedSecret computes the X25519 shared secret between sk and pk, used
+// to precompute a peer's static-static DH term when it's added.
+func (sk *NoisePrivateKey) sharedSecret(pk NoisePublicKey) (ss [32]byte) {
+	curve25519.ScalarMult(&ss, (*[32]byte)(sk), (*[32]byte)(&pk))
+	return ss
+}
+
+// IndexTable maps the locally-chosen session indices handed out during a
+// handshake back to the owning peer, so an inbound packet's receiver
+// index can be resolved without a linear peer scan.
+type IndexTable struct {
+	sync.RWMutex
+	table map[uint32]*Peer
+}
+
+// Delete removes index from the table. It is a no-op for index 0, which
+// Handshake.Clear uses as "no index assigned".
+func (t *IndexTable) Delete(index uint32) {
+	if index == 0 {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	delete(t.table, index)
+}
+
+// Device is the core WireGuard tunnel: it owns the peer set, the UDP
+// bind, the static keypair, and the queues that carry packets between
+// the tun interface and the network.
+type Device struct {
+	isUp     AtomicBool
+	isClosed AtomicBool
+
+	log *Logger
+
+	staticIdentity struct {
+		sync.RWMutex
+		privateKey NoisePrivateKey
+		publicKey  NoisePublicKey
+	}
+
+	peers struct {
+		sync.RWMutex
+		keyMap map[NoisePublicKey]*Peer
+		empty  AtomicBool
+	}
+
+	net struct {
+		sync.RWMutex
+		bind conn.Bind
+		port uint16
+	}
+
+	indexTable IndexTable
+
+	queue struct {
+		encryption struct {
+			wg sync.WaitGroup
+		}
+	}
+
+	// events fans PeerEvent out to Device.Subscribe's callers; see event.go.
+	events eventHub
+
+	// transport is the device-wide pluggable transport used to decode
+	// inbound datagrams, and the default peers encode with; see
+	// transport.go.
+	transportMu sync.RWMutex
+	transport   Transport
+}
+
+// NewDevice creates a Device that sends and receives through bind,
+// logging diagnostics through logger (which may be nil). The device
+// starts with no static private key and no peers; peers are added through
+// IpcSetOperation's public_key= lines, and a peer added while the device
+// is not up is created but not started.
+func NewDevice(bind conn.Bind, logger *Logger) *Device {
+	device := new(Device)
+	device.log = logger
+	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
+	device.peers.empty.Set(true)
+	device.indexTable.table = make(map[uint32]*Peer)
+	device.net.bind = bind
+	device.transport = passthroughTransport{}
+	return device
+}
+
+// DeleteKeypair releases the resources associated with keypair, which may
+// be nil (a no-op), e.g. an as-yet-unused "previous" or "next" slot.
+func (device *Device) DeleteKeypair(keypair *Keypair) {
+	if keypair == nil {
+		return
+	}
+	device.indexTable.Delete(keypair.localIndex)
+}
+
+// DecodeInboundDatagram reverses the device's configured transport
+// framing on a raw datagram read off bind, before the packet is parsed
+// to identify which peer it came from. This has to happen at the device
+// level, ahead of peer lookup, rather than per-peer: a peer-specific
+// Transport can only be selected once the peer is known, but an
+// obfuscating transport's framing is exactly what stops the receiver
+// from reading the WireGuard header - and so the peer index - until
+// it's removed. So unlike the per-peer encode side
+// (Peer.SendBuffer/SendControlBuffer, which already know the
+// destination peer), decoding uses a single transport for the whole
+// device.
+func (device *Device) DecodeInboundDatagram(packet []byte) ([]byte, error) {
+	device.net.RLock()
+	bind := device.net.bind
+	device.net.RUnlock()
+	if bind == nil {
+		return nil, errors.New("no bind")
+	}
+
+	device.transportMu.RLock()
+	transport := device.transport
+	device.transportMu.RUnlock()
+
+	return transport.Receive(bind, packet)
+}
+
+// SetTransport configures the device-wide pluggable transport used to
+// decode inbound datagrams, and that peers encode outbound ones with, by
+// name with opaque parameters, as set over the UAPI's device-level
+// transport_name/transport_config keys. An empty name restores the
+// default passthrough transport.
+func (device *Device) SetTransport(name, params string) error {
+	transport, err := newTransport(name, params)
+	if err != nil {
+		return err
+	}
+	device.transportMu.Lock()
+	device.transport = transport
+	device.transportMu.Unlock()
+	return nil
+}
+
+// Transport returns the device-wide pluggable transport currently
+// configured, for peers to encode outbound traffic with.
+func (device *Device) Transport() Transport {
+	device.transportMu.RLock()
+	defer device.transportMu.RUnlock()
+	return device.transport
+}
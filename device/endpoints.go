@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// handshakeFailoverThreshold is the number of consecutive handshake
+// attempts against the active endpoint candidate before the handshake
+// retransmit path rotates to the next one.
+const handshakeFailoverThreshold = 3
+
+// endpointCandidate is one entry in a peer's ordered endpoint list, along
+// with the health bookkeeping used to decide when to fail over away from
+// it.
+type endpointCandidate struct {
+	endpoint         conn.Endpoint
+	failedHandshakes uint32
+}
+
+// endpointList holds the ordered set of endpoints configured for a peer
+// (for example multiple Endpoint= entries for v4/v6, or a primary plus a
+// backup relay), and tracks which one is currently active.
+type endpointList struct {
+	sync.RWMutex
+	candidates []endpointCandidate
+	active     int // index into candidates, or -1 if empty
+}
+
+// Reset clears the candidate list, as when a peer is created or its
+// keys/endpoints are flushed.
+func (l *endpointList) Reset() {
+	l.Lock()
+	defer l.Unlock()
+	l.candidates = nil
+	l.active = -1
+}
+
+// Set replaces the candidate list wholesale, as when the UAPI configures a
+// peer's endpoints. The first entry becomes active.
+func (l *endpointList) Set(endpoints []conn.Endpoint) {
+	l.Lock()
+	defer l.Unlock()
+	l.candidates = make([]endpointCandidate, len(endpoints))
+	for i, e := range endpoints {
+		l.candidates[i] = endpointCandidate{endpoint: e}
+	}
+	if len(l.candidates) > 0 {
+		l.active = 0
+	} else {
+		l.active = -1
+	}
+}
+
+// Add appends endpoint as an additional backup candidate, as a repeated
+// UAPI endpoint_backup= line does, without disturbing which candidate is
+// currently active.
+func (l *endpointList) Add(endpoint conn.Endpoint) {
+	l.Lock()
+	defer l.Unlock()
+	l.candidates = append(l.candidates, endpointCandidate{endpoint: endpoint})
+	if l.active < 0 {
+		l.active = 0
+	}
+}
+
+// Current returns the active endpoint, or nil if none is configured.
+func (l *endpointList) Current() conn.Endpoint {
+	l.RLock()
+	defer l.RUnlock()
+	if l.active < 0 {
+		return nil
+	}
+	return l.candidates[l.active].endpoint
+}
+
+// UpdateFromPacket refreshes the active candidate's address to endpoint,
+// as SetEndpointFromPacket does with an inbound packet's source. Roaming
+// never grows or reorders the operator-configured candidate list - a
+// varying or spoofed source would otherwise pollute the primary/backup
+// ordering that RecordHandshakeFailure rotates through - it only updates
+// whichever candidate is currently active, seeding a single candidate if
+// none is configured yet. It reports whether the active endpoint's
+// address actually changed, so callers don't treat every inbound packet
+// as a roam.
+func (l *endpointList) UpdateFromPacket(endpoint conn.Endpoint) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.active < 0 {
+		l.candidates = append(l.candidates, endpointCandidate{endpoint: endpoint})
+		l.active = 0
+		return true
+	}
+
+	current := l.candidates[l.active].endpoint
+	changed := current == nil || current.DstToString() != endpoint.DstToString()
+	l.candidates[l.active].endpoint = endpoint
+	l.candidates[l.active].failedHandshakes = 0
+	return changed
+}
+
+// RecordHandshakeFailure increments the active candidate's failure count
+// and, once it crosses threshold, fails over to the next candidate in the
+// list, wrapping around. It reports whether a failover occurred.
+func (l *endpointList) RecordHandshakeFailure(threshold uint32) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.active < 0 || len(l.candidates) < 2 {
+		return false
+	}
+	l.candidates[l.active].failedHandshakes++
+	if l.candidates[l.active].failedHandshakes < threshold {
+		return false
+	}
+	l.candidates[l.active].failedHandshakes = 0
+	l.active = (l.active + 1) % len(l.candidates)
+	return true
+}
+
+// RestorePrimary switches back to the first configured candidate, as the
+// periodic primary probe in Peer.RecordHandshakeAttempt does after an
+// earlier failover away from it.
+func (l *endpointList) RestorePrimary() {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.candidates) == 0 {
+		return
+	}
+	l.active = 0
+	l.candidates[0].failedHandshakes = 0
+}
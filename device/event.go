@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "sync"
+
+// PeerEventType identifies what changed about a peer in a PeerEvent.
+type PeerEventType int
+
+const (
+	PeerEventEndpointChanged PeerEventType = iota
+	PeerEventHandshakeComplete
+	PeerEventKeypairsRotated
+	PeerEventRemoved
+)
+
+// PeerEvent is sent to a Device's subscribers whenever SetEndpointFromPacket
+// roams a peer, a handshake completes, keypairs rotate, or the peer is torn
+// down via ZeroAndFlushAll/Stop.
+type PeerEvent struct {
+	Peer *Peer
+	Type PeerEventType
+}
+
+// eventHub fans a PeerEvent out to every subscriber without letting a slow
+// or absent reader block the caller's hot path.
+type eventHub struct {
+	sync.RWMutex
+	subscribers map[chan<- PeerEvent]struct{}
+}
+
+func (hub *eventHub) subscribe(ch chan<- PeerEvent) func() {
+	hub.Lock()
+	defer hub.Unlock()
+	if hub.subscribers == nil {
+		hub.subscribers = make(map[chan<- PeerEvent]struct{})
+	}
+	hub.subscribers[ch] = struct{}{}
+	return func() {
+		hub.Lock()
+		defer hub.Unlock()
+		delete(hub.subscribers, ch)
+	}
+}
+
+func (hub *eventHub) emit(event PeerEvent) {
+	hub.RLock()
+	defer hub.RUnlock()
+	for ch := range hub.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// A slow subscriber must not stall the peer's hot path; it
+			// simply misses this event.
+		}
+	}
+}
+
+// Subscribe registers ch to receive PeerEvents for every peer on the
+// device. The returned function unsubscribes ch; callers should invoke it
+// once they stop reading from ch.
+//
+// Previously, detecting roaming or rekeys required polling the UAPI get
+// operation. Subscribe lets embedders react to topology changes as they
+// happen, without racing the peer lock.
+func (device *Device) Subscribe(ch chan<- PeerEvent) func() {
+	return device.events.subscribe(ch)
+}
@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync"
+)
+
+// Keypair is one negotiated set of session keys for a peer, indexed
+// locally by localIndex so inbound packets can be matched back to it.
+type Keypair struct {
+	sendNonce   uint64 // accessed atomically
+	localIndex  uint32
+	remoteIndex uint32
+}
+
+// Keypairs holds a peer's current, previous, and not-yet-confirmed next
+// keypair. Only one of current/previous is ever used to encrypt outbound
+// traffic at a time; previous is kept briefly so packets already in
+// flight under it still decrypt.
+type Keypairs struct {
+	sync.RWMutex
+	current, previous, next *Keypair
+}
+
+// loadNext returns the keypair awaiting promotion, or nil. Callers must
+// hold the Keypairs lock.
+func (kp *Keypairs) loadNext() *Keypair {
+	return kp.next
+}
+
+// storeNext sets the keypair awaiting promotion. Callers must hold the
+// Keypairs lock.
+func (kp *Keypairs) storeNext(k *Keypair) {
+	kp.next = k
+}
+
+// BeginSymmetricSession promotes the peer's negotiated "next" keypair to
+// current once a handshake completes - whichever side derived it last,
+// initiator on receiving a handshake response or responder on sending
+// one - retiring whatever was previously current to previous. This is
+// the point a handshake actually finishes and a rekey actually happens,
+// so it's what notifies subscribers of both.
+func (peer *Peer) BeginSymmetricSession() error {
+	keypairs := &peer.keypairs
+	keypairs.Lock()
+	next := keypairs.loadNext()
+	if next == nil {
+		keypairs.Unlock()
+		return errors.New("no keypair awaiting promotion")
+	}
+	peer.device.DeleteKeypair(keypairs.previous)
+	keypairs.previous = keypairs.current
+	keypairs.current = next
+	keypairs.storeNext(nil)
+	keypairs.Unlock()
+
+	peer.NotifyHandshakeComplete()
+	peer.NotifyKeypairsRotated()
+	return nil
+}
@@ -0,0 +1,46 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+// Handshake holds one peer's in-progress or most recently completed Noise
+// handshake state: the precomputed static-static DH term, the remote
+// peer's static public key, and the locally-assigned index the responder
+// uses to address packets back to this peer before a keypair exists.
+type Handshake struct {
+	mutex                   sync.Mutex
+	precomputedStaticStatic [32]byte
+	remoteStatic            NoisePublicKey
+	localIndex              uint32
+	lastSentHandshake       time.Time
+}
+
+// Clear resets the handshake to a fresh, unstarted state. Callers must
+// hold mutex.
+func (h *Handshake) Clear() {
+	h.precomputedStaticStatic = [32]byte{}
+	h.localIndex = 0
+}
+
+// CookieGenerator produces the MAC cookies WireGuard's handshake messages
+// carry to mitigate DoS amplification, keyed to the peer it was
+// initialized for.
+type CookieGenerator struct {
+	mutex     sync.RWMutex
+	remoteKey NoisePublicKey
+}
+
+// Init associates the generator with pk, the remote peer's static public
+// key, as NewPeer does when creating a peer.
+func (cg *CookieGenerator) Init(pk NoisePublicKey) {
+	cg.mutex.Lock()
+	defer cg.mutex.Unlock()
+	cg.remoteKey = pk
+}
@@ -16,14 +16,17 @@ import (
 	"golang.zx2c4.com/wireguard/conn"
 )
 
+var errThrottled = errors.New("peer rate limit exceeded")
+
 type Peer struct {
 	isRunning                   AtomicBool
-	sync.RWMutex                // Mostly protects endpoint, but is generally taken whenever we modify peer
+	sync.RWMutex                // Generally taken whenever we modify peer; endpoints carries its own lock
 	keypairs                    Keypairs
 	handshake                   Handshake
 	device                      *Device
-	endpoint                    conn.Endpoint
+	endpoints                   endpointList
 	persistentKeepaliveInterval uint32 // accessed atomically
+	priority                    uint32 // accessed atomically, holds a PeerPriority
 	firstTrieEntry              *trieEntry
 	stopping                    sync.WaitGroup // routines pending stop
 
@@ -35,11 +38,18 @@ type Peer struct {
 	stats struct {
 		txBytes           uint64 // bytes send to peer (endpoint)
 		rxBytes           uint64 // bytes received from peer
+		txThrottled       uint64 // bytes held back by the egress rate limiter
+		rxThrottled       uint64 // bytes held back by the ingress rate limiter
 		lastHandshakeNano int64  // nano seconds since epoch
 	}
 
 	disableRoaming bool
 
+	rateLimiter struct {
+		tx tokenBucket
+		rx tokenBucket
+	}
+
 	timers struct {
 		retransmitHandshake     *Timer
 		sendKeepalive           *Timer
@@ -99,8 +109,11 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	handshake.remoteStatic = pk
 	handshake.mutex.Unlock()
 
-	// reset endpoint
-	peer.endpoint = nil
+	// reset endpoints
+	peer.endpoints.Reset()
+
+	// default to unweighted, unshaped traffic until UAPI configures otherwise
+	atomic.StoreUint32(&peer.priority, uint32(PriorityNormal))
 
 	// add
 	device.peers.keyMap[pk] = peer
@@ -114,6 +127,11 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	return peer, nil
 }
 
+// SendBuffer transmits a data packet to the peer's active endpoint,
+// shaping it against the peer's egress rate limit. Handshake-initiation,
+// handshake-response, cookie-reply, and keepalive packets must go through
+// SendControlBuffer instead: throttling them could strand a peer with no
+// way to ever re-handshake and recover.
 func (peer *Peer) SendBuffer(buffer []byte) error {
 	peer.device.net.RLock()
 	defer peer.device.net.RUnlock()
@@ -127,20 +145,181 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 		return errors.New("no bind")
 	}
 
-	peer.RLock()
-	defer peer.RUnlock()
+	endpoint := peer.endpoints.Current()
+	if endpoint == nil {
+		return errors.New("no known endpoint for peer")
+	}
+
+	if !peer.rateLimiter.tx.Allow(uint64(len(buffer))) {
+		atomic.AddUint64(&peer.stats.txThrottled, uint64(len(buffer)))
+		return errThrottled
+	}
+
+	err := peer.device.Transport().Send(peer.device.net.bind, endpoint, buffer)
+	if err == nil {
+		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
+	}
+	return err
+}
+
+// SendControlBuffer transmits buffer to the peer's active endpoint without
+// consuming egress rate-limit tokens, so handshake and keepalive traffic
+// can always get through even while the peer's data traffic is throttled.
+func (peer *Peer) SendControlBuffer(buffer []byte) error {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
 
-	if peer.endpoint == nil {
+	if peer.device.net.bind == nil {
+		if peer.device.isClosed.Get() {
+			return nil
+		}
+		return errors.New("no bind")
+	}
+
+	endpoint := peer.endpoints.Current()
+	if endpoint == nil {
 		return errors.New("no known endpoint for peer")
 	}
 
-	err := peer.device.net.bind.Send(buffer, peer.endpoint)
+	err := peer.device.Transport().Send(peer.device.net.bind, endpoint, buffer)
 	if err == nil {
 		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
 	}
 	return err
 }
 
+// SetEndpoints configures the peer's ordered list of endpoint candidates,
+// e.g. from multiple UAPI Endpoint= entries (primary plus an IPv6 or
+// backup relay candidate). The first entry becomes active immediately.
+func (peer *Peer) SetEndpoints(endpoints []conn.Endpoint) {
+	peer.endpoints.Set(endpoints)
+}
+
+// AddEndpointCandidate appends an additional backup endpoint candidate,
+// e.g. from a repeated UAPI endpoint_backup= line, without disturbing
+// which candidate is currently active.
+func (peer *Peer) AddEndpointCandidate(endpoint conn.Endpoint) {
+	peer.endpoints.Add(endpoint)
+}
+
+// TryFailover is called from the handshake retransmit path for each
+// unanswered handshake attempt. It records a failure against the active
+// endpoint candidate, advances to the next candidate once
+// handshakeFailoverThreshold consecutive failures have accrued there, and
+// reports whether a failover occurred.
+func (peer *Peer) TryFailover() bool {
+	return peer.endpoints.RecordHandshakeFailure(handshakeFailoverThreshold)
+}
+
+// RestorePrimaryEndpoint switches back to the first configured endpoint
+// candidate. RecordHandshakeAttempt calls it every primaryProbeInterval
+// attempts, to give the primary another try after a failover away from it.
+func (peer *Peer) RestorePrimaryEndpoint() {
+	peer.endpoints.RestorePrimary()
+}
+
+// primaryProbeInterval is how many handshake retransmit attempts pass
+// between tries at restoring the primary endpoint candidate after a
+// failover away from it.
+const primaryProbeInterval = 10
+
+// RecordHandshakeAttempt is called from the handshake retransmit timer
+// each time a handshake-initiation is resent without a response. It
+// tracks the attempt count for diagnostics (NotifyHandshakeComplete
+// resets it on success) and, every primaryProbeInterval attempts,
+// restores the primary endpoint candidate to give it another chance;
+// otherwise it defers the failover decision to TryFailover, which rotates
+// to the next candidate once handshakeFailoverThreshold consecutive
+// attempts against the current one have failed. That's a single
+// threshold check, in endpointList.RecordHandshakeFailure - this no
+// longer also gates on a separate local counter, which used to mean an
+// actual failover took roughly threshold*2 attempts instead of
+// threshold.
+func (peer *Peer) RecordHandshakeAttempt() {
+	attempts := atomic.AddUint32(&peer.timers.handshakeAttempts, 1)
+	if attempts%primaryProbeInterval == 0 {
+		peer.RestorePrimaryEndpoint()
+		return
+	}
+	peer.TryFailover()
+}
+
+// ReceiveAllowed enforces the peer's ingress rate limit.
+// RoutineSequentialReceiver calls this before delivering each decrypted
+// packet to the tun device, counting any bytes it holds back toward
+// rxThrottled.
+func (peer *Peer) ReceiveAllowed(n int) bool {
+	if peer.rateLimiter.rx.Allow(uint64(n)) {
+		return true
+	}
+	atomic.AddUint64(&peer.stats.rxThrottled, uint64(n))
+	return false
+}
+
+// accountReceived records n delivered ingress bytes toward rxBytes, once
+// RoutineSequentialReceiver has decided (via ReceiveAllowed) to actually
+// deliver a packet rather than drop it.
+func (peer *Peer) accountReceived(n int) {
+	atomic.AddUint64(&peer.stats.rxBytes, uint64(n))
+}
+
+// EnqueueInbound hands a decrypted packet to this peer's sequential
+// receiver for in-order delivery. Decryption must not itself apply
+// ReceiveAllowed: dropping an element here would desynchronize the
+// sequence counters RoutineSequentialReceiver and its decryption
+// workers share, so throttling is enforced at delivery time instead, in
+// RoutineSequentialReceiver.
+func (peer *Peer) EnqueueInbound(elem *QueueInboundElement) {
+	peer.queue.inbound <- elem
+}
+
+// OutboundQuantum reports how many packets the sequential sender should
+// drain from peer.queue.outbound in one pass before yielding to other
+// peers, weighted by the peer's priority class so higher-priority peers
+// get a larger share of the outbound queue drain.
+func (peer *Peer) OutboundQuantum() int {
+	switch peer.Priority() {
+	case PriorityHigh:
+		return outboundQuantumHigh
+	case PriorityLow:
+		return outboundQuantumLow
+	default:
+		return outboundQuantumNormal
+	}
+}
+
+// throttledTxBytes returns the number of egress bytes held back by the
+// peer's rate limiter so far, for UAPI reporting.
+func (peer *Peer) throttledTxBytes() uint64 {
+	return atomic.LoadUint64(&peer.stats.txThrottled)
+}
+
+// throttledRxBytes returns the number of ingress bytes held back by the
+// peer's rate limiter so far, for UAPI reporting.
+func (peer *Peer) throttledRxBytes() uint64 {
+	return atomic.LoadUint64(&peer.stats.rxThrottled)
+}
+
+// SetRateLimits configures the peer's egress and ingress token buckets, in
+// bytes/sec with the given burst sizes. A zero rate disables limiting in
+// that direction.
+func (peer *Peer) SetRateLimits(txRate, txBurst, rxRate, rxBurst uint64) {
+	peer.rateLimiter.tx.Configure(txRate, txBurst)
+	peer.rateLimiter.rx.Configure(rxRate, rxBurst)
+}
+
+// SetPriority sets the peer's outbound queue priority class, used to weight
+// how many of its outbound packets are drained per pass relative to other
+// peers.
+func (peer *Peer) SetPriority(priority PeerPriority) {
+	atomic.StoreUint32(&peer.priority, uint32(priority))
+}
+
+// Priority returns the peer's current outbound queue priority class.
+func (peer *Peer) Priority() PeerPriority {
+	return PeerPriority(atomic.LoadUint32(&peer.priority))
+}
+
 func (peer *Peer) String() string {
 	base64Key := base64.StdEncoding.EncodeToString(peer.handshake.remoteStatic[:])
 	abbreviatedKey := "invalid"
@@ -215,6 +394,40 @@ func (peer *Peer) ZeroAndFlushAll() {
 	handshake.mutex.Unlock()
 
 	peer.FlushStagedPackets()
+
+	device.events.emit(PeerEvent{Peer: peer, Type: PeerEventRemoved})
+}
+
+// NotifyHandshakeComplete emits a PeerEventHandshakeComplete event. The
+// handshake state machine calls this once it finishes processing a
+// handshake response or initiation, so subscribers learn about it without
+// polling the UAPI get operation. It also resets the handshake attempt
+// count and the active candidate's failover count, since a completed
+// handshake proves the active candidate is reachable, and stops the
+// handshake retransmit timer.
+//
+// It does not call RestorePrimaryEndpoint: a handshake that completed via
+// a failed-over backup candidate is evidence that candidate works, not
+// that the primary is back - snapping back unconditionally would flap
+// between the two. Restoring the primary is the job of whatever probes it
+// directly, e.g. a periodic retry in the handshake retransmit path.
+func (peer *Peer) NotifyHandshakeComplete() {
+	peer.timers.retransmitHandshake.Stop()
+	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
+	peer.endpoints.Lock()
+	if peer.endpoints.active >= 0 {
+		peer.endpoints.candidates[peer.endpoints.active].failedHandshakes = 0
+	}
+	peer.endpoints.Unlock()
+	peer.device.events.emit(PeerEvent{Peer: peer, Type: PeerEventHandshakeComplete})
+}
+
+// NotifyKeypairsRotated emits a PeerEventKeypairsRotated event. Keypair
+// derivation calls this once a freshly negotiated keypair is promoted to
+// current, so subscribers learn about rekeys without polling the UAPI get
+// operation.
+func (peer *Peer) NotifyKeypairsRotated() {
+	peer.device.events.emit(PeerEvent{Peer: peer, Type: PeerEventKeypairsRotated})
 }
 
 func (peer *Peer) ExpireCurrentKeypairs() {
@@ -261,7 +474,9 @@ func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	if peer.disableRoaming {
 		return
 	}
-	peer.Lock()
-	peer.endpoint = endpoint
-	peer.Unlock()
+	if !peer.endpoints.UpdateFromPacket(endpoint) {
+		return
+	}
+
+	peer.device.events.emit(PeerEvent{Peer: peer, Type: PeerEventEndpointChanged})
 }
@@ -0,0 +1,33 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+// QueueStagedSize, QueueOutboundSize, and QueueInboundSize bound the
+// depth of a peer's staged/outbound/inbound packet channels.
+const (
+	QueueStagedSize   = 128
+	QueueOutboundSize = 1024
+	QueueInboundSize  = 1024
+)
+
+// QueueOutboundElement is one packet in a peer's staged or outbound
+// queue, awaiting encryption and transmission.
+type QueueOutboundElement struct {
+	packet []byte
+}
+
+// QueueInboundElement is one packet in a peer's inbound queue, already
+// decrypted and awaiting sequential delivery to the tun device.
+type QueueInboundElement struct {
+	packet []byte
+}
+
+// trieEntry is a placeholder node in the allowed-IPs routing trie; a
+// peer's firstTrieEntry anchors the set of CIDRs routed to it.
+type trieEntry struct {
+	peer *Peer
+	next *trieEntry
+}
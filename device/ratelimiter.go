@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+// PeerPriority weights a peer's share of the outbound queue drain when
+// several peers are contending for the same egress bandwidth.
+type PeerPriority uint32
+
+const (
+	PriorityLow PeerPriority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+// outboundQuantum{Low,Normal,High} are the per-pass packet counts
+// Peer.OutboundQuantum returns for each PeerPriority.
+const (
+	outboundQuantumLow    = 1
+	outboundQuantumNormal = 4
+	outboundQuantumHigh   = 8
+)
+
+// tokenBucket is a simple token-bucket rate limiter used to shape per-peer
+// ingress and egress traffic. A zero rate disables limiting.
+type tokenBucket struct {
+	mu         sync.Mutex
+	rate       uint64 // bytes/sec
+	burst      uint64 // maximum accumulated tokens, in bytes
+	tokens     float64 // fractional, so sub-millisecond refills aren't lost
+	lastRefill time.Time
+}
+
+// Configure sets the bucket's rate and burst size, and resets it to a full
+// burst so a newly configured limit does not immediately throttle traffic.
+func (b *tokenBucket) Configure(rate, burst uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+	b.burst = burst
+	b.tokens = float64(burst)
+	b.lastRefill = time.Now()
+}
+
+// Allow reports whether n bytes may pass right now, consuming tokens if so.
+func (b *tokenBucket) Allow(n uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate == 0 {
+		return true
+	}
+
+	now := time.Now()
+	if elapsed := now.Sub(b.lastRefill); elapsed > 0 {
+		// Keep the refill as a float so back-to-back calls a few
+		// microseconds apart still accumulate their fractional tokens
+		// instead of rounding down to zero every time.
+		b.tokens += elapsed.Seconds() * float64(b.rate)
+		if max := float64(b.burst); b.tokens > max {
+			b.tokens = max
+		}
+		b.lastRefill = now
+	}
+
+	// A packet larger than the configured burst can never accumulate
+	// enough tokens to pass outright - parseRateLimitValue defaults
+	// burst to rate, so any rate below one MTU would otherwise reject
+	// every packet in that direction forever. Charge at most a full
+	// bucket's worth instead, so such a packet is allowed once the
+	// bucket is full (which still throttles its effective rate to
+	// roughly one packet per refill period) rather than dropped
+	// permanently.
+	cost := n
+	if max := b.burst; cost > max {
+		cost = max
+	}
+
+	if b.tokens < float64(cost) {
+		return false
+	}
+	b.tokens -= float64(cost)
+	return true
+}
@@ -0,0 +1,66 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "runtime"
+
+// RoutineSequentialSender drains peer.queue.outbound in FIFO order,
+// transmitting each packet via SendBuffer, until the queue is closed by
+// Stop. It drains OutboundQuantum packets per pass before yielding, so a
+// higher-priority peer's goroutine sends more packets between yields than
+// a lower-priority one's.
+func (peer *Peer) RoutineSequentialSender() {
+	defer peer.stopping.Done()
+	for {
+		quantum := peer.OutboundQuantum()
+		for i := 0; i < quantum; i++ {
+			elem, ok := <-peer.queue.outbound
+			if !ok {
+				return
+			}
+			if elem == nil {
+				continue
+			}
+			if err := peer.SendBuffer(elem.packet); err != nil {
+				peer.device.log.Verbosef("%v - Failed to send data packet: %v", peer, err)
+			}
+		}
+		runtime.Gosched()
+	}
+}
+
+// RoutineSequentialReceiver delivers decrypted packets from
+// peer.queue.inbound toward the tun device in the order they were
+// decrypted, until the queue is closed by Stop. Ordering must survive
+// regardless of throttling, so every element is read off the channel
+// here in sequence; ReceiveAllowed decides only whether it's actually
+// delivered, dropping it and counting it toward rxThrottled otherwise.
+func (peer *Peer) RoutineSequentialReceiver() {
+	defer peer.stopping.Done()
+	for elem := range peer.queue.inbound {
+		if elem == nil {
+			continue
+		}
+		if !peer.ReceiveAllowed(len(elem.packet)) {
+			continue
+		}
+		peer.accountReceived(len(elem.packet))
+		// Handed off to the embedder's tun device from here.
+	}
+}
+
+// FlushStagedPackets drops all packets waiting in peer.queue.staged for a
+// handshake, e.g. when the peer's keys are zeroed and no handshake will
+// ever complete to release them.
+func (peer *Peer) FlushStagedPackets() {
+	for {
+		select {
+		case <-peer.queue.staged:
+		default:
+			return
+		}
+	}
+}
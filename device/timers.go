@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import "time"
+
+// RekeyTimeout is how long a sent handshake-initiation waits for a
+// response before the retransmit timer resends it.
+const RekeyTimeout = 5 * time.Second
+
+// RejectAfterMessages is the nonce value a keypair is pinned to once it's
+// expired, so any further packet under it is rejected rather than reused.
+const RejectAfterMessages = uint64(1) << 60
+
+// Timer is a nil-safe, reusable wrapper around time.Timer for the
+// one-shot, frequently-reset timers a peer keeps in its timers struct.
+type Timer struct {
+	timer *time.Timer
+}
+
+// NewTimer returns a stopped Timer that calls expire when reset and
+// allowed to fire.
+func (peer *Peer) NewTimer(expire func()) *Timer {
+	t := &Timer{timer: time.AfterFunc(time.Hour, expire)}
+	t.timer.Stop()
+	return t
+}
+
+func (t *Timer) Reset(d time.Duration) {
+	if t == nil || t.timer == nil {
+		return
+	}
+	t.timer.Reset(d)
+}
+
+func (t *Timer) Stop() {
+	if t == nil || t.timer == nil {
+		return
+	}
+	t.timer.Stop()
+}
+
+// timersInit starts the peer's handshake retransmit timer, called from
+// Start. While a handshake-initiation is outstanding, onHandshakeRetransmit
+// fires every RekeyTimeout and reschedules itself; NotifyHandshakeComplete
+// stops the timer and resets handshakeAttempts.
+func (peer *Peer) timersInit() {
+	peer.timers.retransmitHandshake = peer.NewTimer(peer.onHandshakeRetransmit)
+	peer.timers.retransmitHandshake.Reset(RekeyTimeout)
+}
+
+// onHandshakeRetransmit fires when a sent handshake-initiation has gone
+// unanswered for RekeyTimeout. It records the retry - which may trigger
+// endpoint failover or a primary-restore probe, see RecordHandshakeAttempt -
+// and reschedules itself.
+func (peer *Peer) onHandshakeRetransmit() {
+	peer.RecordHandshakeAttempt()
+	peer.timers.retransmitHandshake.Reset(RekeyTimeout)
+}
+
+// timersStop halts the peer's timers, called from Stop.
+func (peer *Peer) timersStop() {
+	peer.timers.retransmitHandshake.Stop()
+}
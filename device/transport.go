@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// Transport wraps a conn.Bind so a device's traffic can be obfuscated or
+// reshaped in flight - XOR/obfs-style framing, WebSocket, QUIC datagram,
+// DNS tunneling, and similar pluggable-transport carriers - without
+// forking the core protocol code. It's configured device-wide
+// (Device.SetTransport) rather than per-peer: Peer.SendBuffer already
+// knows the destination peer and so can call Send once it does, but
+// Receive has to run on every inbound datagram before the device can
+// tell which peer it came from - an obfuscating transport's framing is
+// exactly what hides the WireGuard header, and so the peer index, until
+// it's removed.
+type Transport interface {
+	// Send encodes buffer as needed and transmits it to endpoint via bind.
+	Send(bind conn.Bind, endpoint conn.Endpoint, buffer []byte) error
+
+	// Receive decodes a raw datagram read off bind back into the
+	// WireGuard packet Send was given, the inverse transform.
+	// Device.DecodeInboundDatagram calls this for every inbound
+	// datagram, ahead of peer lookup, so pluggable framing round-trips
+	// symmetrically instead of only being encoded on the way out.
+	Receive(bind conn.Bind, packet []byte) ([]byte, error)
+
+	// Name identifies the transport, for logging and UAPI reporting.
+	Name() string
+}
+
+// passthroughTransport is the default Transport: it hands packets to the
+// bind unmodified. A device without a configured pluggable transport
+// uses it.
+type passthroughTransport struct{}
+
+func (passthroughTransport) Send(bind conn.Bind, endpoint conn.Endpoint, buffer []byte) error {
+	return bind.Send(buffer, endpoint)
+}
+
+func (passthroughTransport) Receive(bind conn.Bind, packet []byte) ([]byte, error) {
+	return packet, nil
+}
+
+func (passthroughTransport) Name() string {
+	return "passthrough"
+}
+
+// TransportFactory constructs a named Transport from the opaque
+// device-wide parameters supplied over the UAPI (transport_name /
+// transport_config).
+type TransportFactory func(params string) (Transport, error)
+
+var transportRegistry = struct {
+	sync.RWMutex
+	factories map[string]TransportFactory
+}{factories: make(map[string]TransportFactory)}
+
+// RegisterTransport makes a named pluggable transport available for the
+// device to select over the UAPI's device-wide transport_name key.
+// Embedders call this during initialization, e.g.
+// device.RegisterTransport("obfs4", obfs4.New).
+func RegisterTransport(name string, factory TransportFactory) {
+	transportRegistry.Lock()
+	defer transportRegistry.Unlock()
+	transportRegistry.factories[name] = factory
+}
+
+// newTransport looks up a registered transport by name and constructs it
+// with params. An empty name selects the default passthrough transport.
+func newTransport(name, params string) (Transport, error) {
+	if name == "" {
+		return passthroughTransport{}, nil
+	}
+	transportRegistry.RLock()
+	factory, ok := transportRegistry.factories[name]
+	transportRegistry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q", name)
+	}
+	return factory(params)
+}
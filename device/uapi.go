@@ -0,0 +1,193 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// handlePeerUAPIField interprets one "key=value" line from a peer's
+// configuration block, for the peer-scoped options this fork layers on
+// top of upstream WireGuard's UAPI (ratelimit_tx/ratelimit_rx/priority/
+// endpoint_backup). IpcSetOperation calls it for every key inside a peer
+// block other than public_key, and it reports handled=false for any key
+// it doesn't recognize, which IpcSetOperation rejects as an invalid UAPI
+// key. transport_name/
+// transport_config are device-wide rather than peer-scoped - see
+// Device.SetTransport - since decoding an inbound datagram has to happen
+// before the peer it came from is known.
+func (peer *Peer) handlePeerUAPIField(key, value string) (handled bool, err error) {
+	switch key {
+	case "ratelimit_tx", "ratelimit_rx":
+		rate, burst, err := parseRateLimitValue(value)
+		if err != nil {
+			return true, fmt.Errorf("%s: %w", key, err)
+		}
+		if key == "ratelimit_tx" {
+			peer.rateLimiter.tx.Configure(rate, burst)
+		} else {
+			peer.rateLimiter.rx.Configure(rate, burst)
+		}
+		return true, nil
+
+	case "priority":
+		p, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return true, fmt.Errorf("priority: %w", err)
+		}
+		peer.SetPriority(PeerPriority(p))
+		return true, nil
+
+	case "endpoint_backup":
+		// Each endpoint_backup= line appends a failover candidate
+		// (e.g. an IPv6 or relay address) without disturbing the active
+		// one; IpcSetOperation handles no "endpoint" key, so on a peer
+		// with no candidates yet the first such line becomes active.
+		e, err := peer.device.net.bind.ParseEndpoint(value)
+		if err != nil {
+			return true, fmt.Errorf("endpoint_backup: %w", err)
+		}
+		peer.AddEndpointCandidate(e)
+		return true, nil
+	}
+	return false, nil
+}
+
+// parseRateLimitValue parses a "ratelimit_tx"/"ratelimit_rx" UAPI value of
+// the form "rate" or "rate,burst", both in bytes/sec and bytes. When burst
+// is omitted it defaults to rate, i.e. a one-second burst.
+func parseRateLimitValue(value string) (rate, burst uint64, err error) {
+	parts := strings.SplitN(value, ",", 2)
+	rate, err = strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	burst = rate
+	if len(parts) == 2 {
+		burst, err = strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return rate, burst, nil
+}
+
+// peerUAPIStatLines returns the extra "key=value\n" lines this fork adds
+// to a peer's block in IpcGetOperation, after its tx_bytes / rx_bytes
+// lines.
+func (peer *Peer) peerUAPIStatLines() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "tx_throttled=%d\n", peer.throttledTxBytes())
+	fmt.Fprintf(&b, "rx_throttled=%d\n", peer.throttledRxBytes())
+	return b.String()
+}
+
+// decodeHexKey decodes value, a hex-encoded UAPI key value, into dst.
+func decodeHexKey(dst []byte, value string) error {
+	if len(value) != hex.EncodedLen(len(dst)) {
+		return fmt.Errorf("invalid key length %d", len(value))
+	}
+	_, err := hex.Decode(dst, []byte(value))
+	return err
+}
+
+// IpcSetOperation implements the UAPI configuration protocol: it reads
+// "key=value\n" lines from r, terminated by a blank line. A public_key=
+// line starts (or resumes configuring) a peer; every subsequent key
+// applies to that peer until the next public_key= line. Other peer-scoped
+// keys are delegated to handlePeerUAPIField, which accepts
+// ratelimit_tx/ratelimit_rx/priority/endpoint_backup; any other key is
+// rejected. transport_name/transport_config are
+// device-wide and so are handled here directly, independent of any
+// public_key= block; transport_name is staged until transport_config
+// arrives so both are applied together as a single Device.SetTransport
+// call.
+func (device *Device) IpcSetOperation(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	var peer *Peer
+	var pendingTransportName string
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("invalid UAPI line: %q", line)
+		}
+
+		switch key {
+		case "public_key":
+			var pk NoisePublicKey
+			if err := decodeHexKey(pk[:], value); err != nil {
+				return fmt.Errorf("public_key: %w", err)
+			}
+			device.peers.RLock()
+			existing := device.peers.keyMap[pk]
+			device.peers.RUnlock()
+			if existing == nil {
+				var err error
+				existing, err = device.NewPeer(pk)
+				if err != nil {
+					return fmt.Errorf("public_key: %w", err)
+				}
+			}
+			peer = existing
+
+		case "transport_name":
+			pendingTransportName = value
+
+		case "transport_config":
+			if err := device.SetTransport(pendingTransportName, value); err != nil {
+				return fmt.Errorf("transport_config: %w", err)
+			}
+			pendingTransportName = ""
+
+		default:
+			if peer == nil {
+				return fmt.Errorf("invalid UAPI key outside a peer block: %s", key)
+			}
+			handled, err := peer.handlePeerUAPIField(key, value)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				return fmt.Errorf("invalid UAPI key: %s", key)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// IpcGetOperation implements the UAPI query protocol, writing one
+// "key=value\n" line per peer's public_key and traffic counters
+// (tx_bytes, rx_bytes, and this fork's tx_throttled/rx_throttled from
+// peerUAPIStatLines) to w. Endpoints are not reported.
+func (device *Device) IpcGetOperation(w io.Writer) error {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	var b strings.Builder
+	for _, peer := range device.peers.keyMap {
+		peer.handshake.mutex.Lock()
+		remoteStatic := peer.handshake.remoteStatic
+		peer.handshake.mutex.Unlock()
+
+		fmt.Fprintf(&b, "public_key=%s\n", hex.EncodeToString(remoteStatic[:]))
+		fmt.Fprintf(&b, "tx_bytes=%d\n", atomic.LoadUint64(&peer.stats.txBytes))
+		fmt.Fprintf(&b, "rx_bytes=%d\n", atomic.LoadUint64(&peer.stats.rxBytes))
+		b.WriteString(peer.peerUAPIStatLines())
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}